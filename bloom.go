@@ -0,0 +1,209 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// bloomSaturation is the fraction of the filter's sized item count n
+// past which Add stops consulting the bloom filter and goes straight to
+// the HLL registers: past this point the filter's false positive rate
+// has grown enough that it's no longer worth the hashing.
+const bloomSaturation = 1.0
+
+// HyperLogLogPlusBloom wraps a HyperLogLog with a small bloom filter
+// that catches duplicates before they ever reach the HLL registers.
+// This makes Add exact for roughly the first n items (the size the
+// filter was built for) and removes essentially all of the variance
+// HyperLogLog otherwise has in the low end of its range, where its own
+// linear-counting correction is weakest.
+type HyperLogLogPlusBloom struct {
+	*HyperLogLog
+
+	bits     []uint64
+	k        uint32 // number of hash functions
+	n        uint64 // distinct items the filter was sized for
+	inserted uint64 // distinct items the bloom filter has accepted
+	bypass   bool   // true once the filter is considered saturated
+}
+
+// NewPlusBloom creates a HyperLogLogPlusBloom whose HLL++ sketch uses
+// dense precision p and sparse precision pp (see NewPlus), fronted by a
+// bloom filter sized for about n distinct items at a ~1% false positive
+// rate.
+func NewPlusBloom(p, pp uint8, n uint) (*HyperLogLogPlusBloom, error) {
+	hll, err := NewPlus(p, pp)
+	if err != nil {
+		return nil, err
+	}
+
+	bits, k := bloomSize(n)
+	return &HyperLogLogPlusBloom{
+		HyperLogLog: hll,
+		bits:        make([]uint64, (bits+63)/64),
+		k:           k,
+		n:           uint64(n),
+	}, nil
+}
+
+// bloomSize picks a bit count and hash function count targeting about a
+// 1% false positive rate at n items, via the standard formulas
+// m = -n*ln(p)/ln(2)^2 and k = (m/n)*ln(2).
+func bloomSize(n uint) (bits uint, k uint32) {
+	if n == 0 {
+		n = 1
+	}
+	const falsePositiveRate = 0.01
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k = uint32(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return uint(m), k
+}
+
+// Add adds a 32-bit hash to the sketch. While the bloom filter isn't
+// saturated, a value the filter reports as already seen is absorbed by
+// it and never touches the HLL registers; any other value goes to both.
+// A new value whose bloom positions are all set already (a false
+// positive) is absorbed as well.
+func (hb *HyperLogLogPlusBloom) Add(val uint32) {
+	if hb.bypass {
+		hb.HyperLogLog.Add(val)
+		return
+	}
+
+	if hb.testAndSet(val) {
+		return
+	}
+	hb.HyperLogLog.Add(val)
+
+	if float64(hb.inserted) > bloomSaturation*float64(hb.n) {
+		hb.bypass = true
+	}
+}
+
+// Count returns the estimated cardinality. While the bloom filter
+// hasn't saturated, every item added has passed through testAndSet, so
+// its tally of items reported as new is returned instead of the noisier
+// HLL estimate. A distinct item hit by a bloom false positive is not in
+// that tally.
+func (hb *HyperLogLogPlusBloom) Count() uint64 {
+	if !hb.bypass {
+		return hb.inserted
+	}
+	return hb.HyperLogLog.Count()
+}
+
+// testAndSet hashes val with double hashing (h_i = h1 + i*h2, using the
+// package's existing Murmur32/Murmur64) across hb.k bloom positions,
+// setting any that aren't already set. It reports whether val had
+// already been seen (all k positions were already set).
+func (hb *HyperLogLogPlusBloom) testAndSet(val uint32) bool {
+	h1 := Murmur32(val)
+	h2 := Murmur64(uint64(val))
+
+	nbits := uint32(len(hb.bits) * 64)
+	seen := true
+	for i := uint32(0); i < hb.k; i++ {
+		idx := (h1 + i*h2) % nbits
+		word, bit := idx/64, idx%64
+		mask := uint64(1) << bit
+		if hb.bits[word]&mask == 0 {
+			seen = false
+			hb.bits[word] |= mask
+		}
+	}
+	if !seen {
+		hb.inserted++
+	}
+	return seen
+}
+
+// Reset clears both the bloom filter and the underlying HLL sketch.
+func (hb *HyperLogLogPlusBloom) Reset() {
+	hb.HyperLogLog.Reset()
+	for i := range hb.bits {
+		hb.bits[i] = 0
+	}
+	hb.inserted = 0
+	hb.bypass = false
+}
+
+// Merge merges another HyperLogLogPlusBloom into this one: the bloom
+// bitsets are OR'd together (which can only add false positives, never
+// drop a previously-seen item) and the underlying HLL sketches are
+// merged via HyperLogLog.Merge.
+func (hb *HyperLogLogPlusBloom) Merge(other *HyperLogLogPlusBloom) {
+	hb.HyperLogLog.Merge(other.HyperLogLog)
+
+	if len(hb.bits) != len(other.bits) {
+		panic(fmt.Errorf("bloom filter size doesn't match: %d != %d", len(hb.bits)*64, len(other.bits)*64))
+	}
+	for i, w := range other.bits {
+		hb.bits[i] |= w
+	}
+	hb.inserted += other.inserted
+
+	if float64(hb.inserted) > bloomSaturation*float64(hb.n) {
+		hb.bypass = true
+	}
+}
+
+// MarshalBinary encodes hb as the underlying HLL sketch (see
+// HyperLogLog.MarshalBinary) immediately followed by the bloom filter
+// state: hash count, sized item count, items inserted, the number of
+// 64-bit words in the bitset and the raw words.
+func (hb *HyperLogLogPlusBloom) MarshalBinary() ([]byte, error) {
+	return hb.AppendBinary(nil)
+}
+
+// AppendBinary appends hb's binary encoding to b.
+func (hb *HyperLogLogPlusBloom) AppendBinary(b []byte) ([]byte, error) {
+	b, err := hb.HyperLogLog.AppendBinary(b)
+	if err != nil {
+		return nil, err
+	}
+
+	b = binary.BigEndian.AppendUint32(b, hb.k)
+	b = binary.BigEndian.AppendUint64(b, hb.n)
+	b = binary.BigEndian.AppendUint64(b, hb.inserted)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(hb.bits)))
+	for _, w := range hb.bits {
+		b = binary.BigEndian.AppendUint64(b, w)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a payload produced by MarshalBinary into hb,
+// replacing its current contents.
+func (hb *HyperLogLogPlusBloom) UnmarshalBinary(data []byte) error {
+	if hb.HyperLogLog == nil {
+		hb.HyperLogLog = &HyperLogLog{}
+	}
+	consumed, err := hb.HyperLogLog.unmarshalBinaryPrefix(data)
+	if err != nil {
+		return err
+	}
+	rest := data[consumed:]
+
+	if len(rest) < 24 {
+		return fmt.Errorf("hyperloglog: truncated bloom header")
+	}
+	hb.k = binary.BigEndian.Uint32(rest)
+	hb.n = binary.BigEndian.Uint64(rest[4:])
+	hb.inserted = binary.BigEndian.Uint64(rest[12:])
+	nwords := binary.BigEndian.Uint32(rest[20:])
+	rest = rest[24:]
+
+	if uint32(len(rest)) < nwords*8 {
+		return fmt.Errorf("hyperloglog: truncated bloom bits")
+	}
+	hb.bits = make([]uint64, nwords)
+	for i := range hb.bits {
+		hb.bits[i] = binary.BigEndian.Uint64(rest[i*8:])
+	}
+	hb.bypass = float64(hb.inserted) > bloomSaturation*float64(hb.n)
+	return nil
+}
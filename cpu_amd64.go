@@ -0,0 +1,16 @@
+//go:build amd64
+
+package hyperloglog
+
+//go:noescape
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+// hasAVX2 is detected once at init time and used to pick the register
+// merge strategy in Merge.
+var hasAVX2 = detectAVX2()
+
+func detectAVX2() bool {
+	_, ebx, _, _ := cpuid(7, 0)
+	const avx2Bit = 1 << 5
+	return ebx&avx2Bit != 0
+}
@@ -117,6 +117,24 @@ func TestReset(t *testing.T) {
 	testReset(t, 512, 1_000_000, 10)
 }
 
+func TestPlusBloom(t *testing.T) {
+	const n = 1000
+
+	hb, err := NewPlusBloom(11, 20, n)
+	if err != nil {
+		t.Fatalf("can't make NewPlusBloom: %v", err)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		hb.Add(Murmur64(i))
+		hb.Add(Murmur64(i)) // duplicate; must not move the estimate
+	}
+
+	if actualError := math.Abs(geterror(n, hb.Count())); actualError > 0.01 {
+		t.Errorf("error=%.5f too high for %d items behind the bloom front; estimated=%d", actualError, uint64(n), hb.Count())
+	}
+}
+
 func TestMerge(t *testing.T) {
 	trueDisinctPerHll := uint64(100000)
 	m := uint(math.Pow(2, float64(11)))
@@ -247,11 +265,11 @@ func TestMaxSWAR(t *testing.T) {
 	}
 }
 
-func BenchmarkMerge(b *testing.B) {
+func benchmarkMerge(b *testing.B, registers int) {
 	words := dictionary(0)
 	words0 := words[:len(words)/2]
 	words1 := words[len(words0):]
-	m := uint(math.Pow(2, float64(11)))
+	m := uint(math.Pow(2, float64(registers)))
 
 	h, err := New(m)
 	h2, err := New(m)
@@ -310,3 +328,42 @@ func BenchmarkMerge(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkMerge(b *testing.B) {
+	benchmarkMerge(b, 11)
+}
+
+func BenchmarkMerge16384(b *testing.B) {
+	benchmarkMerge(b, 14)
+}
+
+func TestMergeAll(t *testing.T) {
+	m := uint(math.Pow(2, float64(11)))
+
+	h, err := New(m)
+	a, erra := New(m)
+	c, errc := New(m)
+	if err != nil || erra != nil || errc != nil {
+		t.Fatalf("can't make New(%d): %v / %v / %v", m, err, erra, errc)
+	}
+
+	for i := uint64(0); i < 50000; i++ {
+		a.Add(Murmur64(i))
+	}
+	for i := uint64(50000); i < 100000; i++ {
+		c.Add(Murmur64(i))
+	}
+
+	h.MergeAll(a, c)
+
+	want, err := New(m)
+	if err != nil {
+		t.Fatalf("can't make New(%d): %v", m, err)
+	}
+	want.Merge(a)
+	want.Merge(c)
+
+	if h.Count() != want.Count() {
+		t.Errorf("MergeAll estimate mismatch, %d != %d", h.Count(), want.Count())
+	}
+}
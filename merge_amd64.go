@@ -0,0 +1,27 @@
+//go:build amd64
+
+package hyperloglog
+
+// simdTileSize is the number of registers maxBytesAVX2 consumes per
+// VPMAXUB: 32 bytes (one YMM register) at a time.
+const simdTileSize = 32
+
+//go:noescape
+func maxBytesAVX2(dst, src *byte, n int)
+
+// mergeSIMDTile overwrites the leading SIMD-aligned prefix of dst with
+// the elementwise max of dst and src using AVX2, and reports how many
+// bytes it consumed. The caller is responsible for the remainder.
+// Reports 0 (consuming nothing) on CPUs without AVX2, so Merge falls
+// back to its plain scalar loop for the whole slice.
+func mergeSIMDTile(dst, src []uint8) int {
+	if !hasAVX2 {
+		return 0
+	}
+	n := len(dst) - len(dst)%simdTileSize
+	if n == 0 {
+		return 0
+	}
+	maxBytesAVX2(&dst[0], &src[0], n)
+	return n
+}
@@ -0,0 +1,23 @@
+//go:build arm64
+
+package hyperloglog
+
+// simdTileSize is the number of registers maxBytesNEON consumes per
+// UMAX: 16 bytes (one 128-bit vector register) at a time. NEON is part
+// of the baseline arm64 ISA, so no runtime feature check is needed.
+const simdTileSize = 16
+
+//go:noescape
+func maxBytesNEON(dst, src *byte, n int)
+
+// mergeSIMDTile overwrites the leading SIMD-aligned prefix of dst with
+// the elementwise max of dst and src using NEON, and reports how many
+// bytes it consumed. The caller is responsible for the remainder.
+func mergeSIMDTile(dst, src []uint8) int {
+	n := len(dst) - len(dst)%simdTileSize
+	if n == 0 {
+		return 0
+	}
+	maxBytesNEON(&dst[0], &src[0], n)
+	return n
+}
@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+
+package hyperloglog
+
+// simdTileSize is 0 on architectures without a dedicated merge
+// implementation: mergeSIMDTile consumes nothing and Merge falls back
+// to its plain scalar loop for the whole slice.
+const simdTileSize = 0
+
+func mergeSIMDTile(dst, src []uint8) int {
+	return 0
+}
@@ -30,8 +30,6 @@ func MurmurString(key string) uint32 {
 	strHeader := (*reflect.StringHeader)(unsafe.Pointer(&key))
 	blen := strHeader.Len
 
-	l := blen / 4 // chunk length
-
 	if strHeader.Len >= 4 {
 	// for each 4 byte chunk of `key'
 	for k := Advance(strHeader); strHeader.Len >= 4; k = Advance(strHeader) {
@@ -128,6 +126,149 @@ func Murmur64(i uint64) uint32 {
 	return h
 }
 
+const uint64Size = unsafe.Sizeof(uint64(0))
+
+func advance64(sh *reflect.StringHeader) uint64 {
+	chunk := unsafe.Slice((*byte)(unsafe.Pointer(sh.Data)), uint64Size)
+	k := binary.LittleEndian.Uint64(chunk)
+	sh.Len -= int(uint64Size)
+	sh.Data += uint64Size
+	return k
+}
+
+func rotl64(x uint64, r uint8) uint64 {
+	return (x << r) | (x >> (64 - r))
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// MurmurString64 implements a fast version of the murmur3 x64 hash
+// function for strings on little endian machines, using the 64-bit
+// finalizer so the result needs no truncation. Suitable for adding
+// strings to a HyperLogLog built with New64.
+func MurmurString64(key string) uint64 {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+	var h, k uint64
+
+	strHeader := (*reflect.StringHeader)(unsafe.Pointer(&key))
+	blen := strHeader.Len
+
+	if strHeader.Len >= 8 {
+		for strHeader.Len >= 8 {
+			k := advance64(strHeader)
+			k *= c1
+			k = rotl64(k, 31)
+			k *= c2
+			h ^= k
+			h = rotl64(h, 27)
+			h = h*5 + 0x52dce729
+		}
+	}
+
+	k = 0
+	// remainder
+	tail := unsafe.Slice((*byte)(unsafe.Pointer(strHeader.Data)), strHeader.Len)
+	for i := strHeader.Len - 1; i >= 0; i-- {
+		k ^= uint64(tail[i]) << uint(8*i)
+	}
+	if strHeader.Len > 0 {
+		k *= c1
+		k = rotl64(k, 31)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint64(blen)
+	h = fmix64(h)
+
+	runtime.KeepAlive(&key)
+
+	return h
+}
+
+// Murmur64_64 implements a fast version of the murmur3 x64 hash
+// function for a single uint64 on little endian machines, using the
+// 64-bit finalizer so the result needs no truncation. Suitable for
+// adding 64bit integers to a HyperLogLog built with New64.
+func Murmur64_64(i uint64) uint64 {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+	var h1, h2 uint64
+
+	k1 := i
+	k1 *= c1
+	k1 = rotl64(k1, 31)
+	k1 *= c2
+	h1 ^= k1
+
+	h1 = rotl64(h1, 27)
+	h1 += h2
+	h1 = h1*5 + 0x52dce729
+
+	h1 ^= 8
+	h2 ^= 8
+
+	h1 += h2
+	h2 += h1
+
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+
+	h1 += h2
+	h2 += h1
+
+	return h1 ^ h2
+}
+
+// Murmur128_64 implements a fast version of the murmur3 x64 hash
+// function for two uint64s (128 bits) on little endian machines, using
+// the 64-bit finalizer so the result needs no truncation. Suitable for
+// adding a 128bit value to a HyperLogLog built with New64.
+func Murmur128_64(i, j uint64) uint64 {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+	var h1, h2 uint64
+
+	k1, k2 := i, j
+
+	k1 *= c1
+	k1 = rotl64(k1, 31)
+	k1 *= c2
+	h1 ^= k1
+
+	h1 = rotl64(h1, 27)
+	h1 += h2
+	h1 = h1*5 + 0x52dce729
+
+	k2 *= c2
+	k2 = rotl64(k2, 33)
+	k2 *= c1
+	h2 ^= k2
+
+	h2 = rotl64(h2, 31)
+	h2 += h1
+	h2 = h2*5 + 0x38495ab5
+
+	h1 ^= 16
+	h2 ^= 16
+
+	h1 += h2
+	h2 += h1
+
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+
+	h1 += h2
+	h2 += h1
+
+	return h1 ^ h2
+}
+
 // Murmur128 implements a fast version of the murmur hash function for two uint64s
 // for little endian machines.  Suitable for adding a 128bit value to an HLL counter.
 func Murmur128(i, j uint64) uint32 {